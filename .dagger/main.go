@@ -3,6 +3,9 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"sync"
+
 	"dagger/mcp-apps-ra/internal/dagger"
 )
 
@@ -16,21 +19,358 @@ const (
 	DefaultPort      = 3001
 )
 
+// defaultBuildExcludes lists directories that rarely belong in a build
+// context and that slow down BuildKit transfers when left in.
+var defaultBuildExcludes = []string{"node_modules", ".venv", "dist", ".git"}
+
+// filterSource applies exclude/include filters to a directory before it is
+// used as a build context. Excludes default to defaultBuildExcludes unless
+// the caller overrides them.
+func filterSource(source *dagger.Directory, exclude, include []string) *dagger.Directory {
+	if len(exclude) == 0 {
+		exclude = defaultBuildExcludes
+	}
+
+	return dag.Directory().WithDirectory(".", source, dagger.DirectoryWithDirectoryOpts{
+		Exclude: exclude,
+		Include: include,
+	})
+}
+
+// devContainer returns the base image with source mounted and dependencies
+// installed, used as the common starting point for Lint and Test.
+func (m *McpAppsRa) devContainer(source *dagger.Directory) *dagger.Container {
+	return dag.Container().
+		From("node:20-alpine").
+		WithDirectory("/src", source).
+		WithWorkdir("/src").
+		WithExec([]string{"npm", "ci"})
+}
+
+// Lint runs the project's linter inside a container built from source
+func (m *McpAppsRa) Lint(
+	ctx context.Context,
+	// Source directory containing the application code
+	// +defaultPath="/"
+	source *dagger.Directory,
+) (string, error) {
+	return m.devContainer(source).
+		WithExec([]string{"npm", "run", "lint"}).
+		Stdout(ctx)
+}
+
+// Test runs the project's test suite inside a container built from source,
+// returning the coverage results as a directory with the JUnit XML reports
+// under /junit. It does not write anything to the host itself.
+func (m *McpAppsRa) Test(
+	ctx context.Context,
+	// Source directory containing the application code
+	// +defaultPath="/"
+	source *dagger.Directory,
+) (*dagger.Directory, error) {
+	container := m.devContainer(source).
+		WithEnvVariable("JEST_JUNIT_OUTPUT_DIR", "/src/junit").
+		WithExec([]string{"npm", "test", "--", "--ci", "--coverage", "--reporters=default", "--reporters=jest-junit"})
+
+	if _, err := container.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("test stage failed: %w", err)
+	}
+
+	return container.Directory("/src/coverage").
+		WithDirectory("/junit", container.Directory("/src/junit")), nil
+}
+
+// ciArtifactsDir is the host-relative path CI exports JUnit/coverage
+// artifacts to.
+const ciArtifactsDir = "./ci-artifacts"
+
+// CIReport summarizes the outcome of each CI stage
+type CIReport struct {
+	BuildError   string
+	LintError    string
+	TestError    string
+	PublishError string
+	// Artifacts is the host path JUnit XML and coverage were exported to, if
+	// the test stage succeeded.
+	Artifacts string
+	// PublishRef is the published image reference (including digest), set
+	// only when the publish stage ran and succeeded.
+	PublishRef string
+}
+
+// CI orchestrates build, lint and test as concurrent stages, exporting
+// JUnit/coverage artifacts from the test stage back to the host, then
+// optionally publishes the image once those stages succeed. Call it locally
+// with `dagger call ci --source=.` or from GitHub Actions.
+func (m *McpAppsRa) CI(
+	ctx context.Context,
+	// Source directory containing the application code
+	// +defaultPath="/"
+	source *dagger.Directory,
+	// Cancel the remaining stages as soon as one fails, instead of always
+	// running all of them to completion
+	// +optional
+	// +default=false
+	failFast bool,
+	// Publish the built image once build, lint and test succeed
+	// +optional
+	// +default=false
+	publish bool,
+	// Registry to push the image to when publish is set
+	// +optional
+	// +default="docker.io"
+	registry string,
+	// Image repository to push to when publish is set
+	// +optional
+	// +default="riksarkivet/mcp-apps-ra"
+	repo string,
+	// Tags to apply to the published image when publish is set
+	// +optional
+	// +default=["latest"]
+	tags []string,
+	// Registry username, required when publish is set
+	// +optional
+	username string,
+	// Registry password or token, required when publish is set
+	// +optional
+	password *dagger.Secret,
+	// Target platforms to publish when publish is set
+	// +optional
+	// +default=["linux/amd64", "linux/arm64"]
+	platforms []string,
+) (*CIReport, error) {
+	runCtx := ctx
+	cancel := func() {}
+	if failFast {
+		runCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	report := &CIReport{}
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		container, err := m.Build(runCtx, source, nil, nil)
+		if err == nil {
+			_, err = container.Sync(runCtx)
+		}
+		if err != nil {
+			report.BuildError = err.Error()
+			cancel()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		if _, err := m.Lint(runCtx, source); err != nil {
+			report.LintError = err.Error()
+			cancel()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		artifacts, err := m.Test(runCtx, source)
+		if err == nil {
+			_, err = artifacts.Export(runCtx, ciArtifactsDir)
+		}
+		if err != nil {
+			report.TestError = err.Error()
+			cancel()
+		} else {
+			report.Artifacts = ciArtifactsDir
+		}
+	}()
+
+	wg.Wait()
+
+	if report.BuildError != "" || report.LintError != "" || report.TestError != "" {
+		return report, fmt.Errorf("one or more CI stages failed")
+	}
+
+	if publish {
+		ref, err := m.Publish(ctx, source, registry, repo, tags, username, password, platforms)
+		if err != nil {
+			report.PublishError = err.Error()
+			return report, fmt.Errorf("publish stage failed: %w", err)
+		}
+		report.PublishRef = ref
+	}
+
+	return report, nil
+}
+
 // Build creates a production-ready container image
 func (m *McpAppsRa) Build(
 	ctx context.Context,
 	// Source directory containing Dockerfile and application code
 	// +defaultPath="/"
 	source *dagger.Directory,
+	// Directories/files to exclude from the build context
+	// +optional
+	exclude []string,
+	// Directories/files to include in the build context, excluding everything else
+	// +optional
+	include []string,
 ) (*dagger.Container, error) {
 	container := dag.Container().
-		Build(source, dagger.ContainerBuildOpts{
+		Build(filterSource(source, exclude, include), dagger.ContainerBuildOpts{
 			Dockerfile: "Dockerfile",
 		})
 
 	return container, nil
 }
 
+// BuildNative reproduces the Dockerfile build stage-by-stage using pure
+// Dagger API calls instead of the Dockerfile frontend. This lets the
+// pipeline benefit from BuildKit's content-addressed cache across CI runs
+// and lets npm installs use a persistent cache volume, which a Dockerfile
+// cannot express on its own. Build remains the Dockerfile-based entrypoint
+// for backwards compatibility.
+func (m *McpAppsRa) BuildNative(
+	ctx context.Context,
+	// Source directory containing application code
+	// +defaultPath="/"
+	source *dagger.Directory,
+	// Directories/files to exclude from the build context
+	// +optional
+	exclude []string,
+	// Directories/files to include in the build context, excluding everything else
+	// +optional
+	include []string,
+) (*dagger.Container, error) {
+	src := filterSource(source, exclude, include)
+
+	builder := dag.Container().
+		From("node:20-alpine").
+		WithMountedCache("/root/.npm", dag.CacheVolume("mcp-apps-ra-npm-cache")).
+		WithDirectory("/src", src).
+		WithWorkdir("/src").
+		WithExec([]string{"npm", "ci"}).
+		WithExec([]string{"npm", "run", "build"}).
+		WithExec([]string{"npm", "prune", "--omit=dev"})
+
+	return dag.Container().
+		From("node:20-alpine").
+		WithWorkdir("/src").
+		WithDirectory("/src", builder.Directory("/src")).
+		WithEntrypoint([]string{"npm", "run", "start"}).
+		WithExposedPort(DefaultPort), nil
+}
+
+// Publish builds multi-arch images from the Dockerfile and pushes them to a
+// registry as a single manifest list, returning the fully qualified image
+// reference including digest so downstream deploy steps can pin by digest.
+func (m *McpAppsRa) Publish(
+	ctx context.Context,
+	// Source directory containing Dockerfile and application code
+	// +defaultPath="/"
+	source *dagger.Directory,
+	// Registry to push the image to
+	// +optional
+	// +default="docker.io"
+	registry string,
+	// Image repository, e.g. "riksarkivet/mcp-apps-ra"
+	// +optional
+	// +default="riksarkivet/mcp-apps-ra"
+	repo string,
+	// Tags to apply to the published image
+	// +optional
+	// +default=["latest"]
+	tags []string,
+	// Registry username
+	username string,
+	// Registry password or token
+	password *dagger.Secret,
+	// Target platforms to build and publish
+	// +optional
+	// +default=["linux/amd64", "linux/arm64"]
+	platforms []string,
+) (string, error) {
+	if registry == "" {
+		registry = DefaultRegistry
+	}
+	if repo == "" {
+		repo = DefaultImageRepo
+	}
+	if len(tags) == 0 {
+		tags = []string{"latest"}
+	}
+	if len(platforms) == 0 {
+		platforms = []string{"linux/amd64", "linux/arm64"}
+	}
+
+	variants := make([]*dagger.Container, 0, len(platforms))
+	for _, platform := range platforms {
+		container := dag.Container(dagger.ContainerOpts{Platform: dagger.Platform(platform)}).
+			Build(source, dagger.ContainerBuildOpts{
+				Dockerfile: "Dockerfile",
+			})
+
+		variants = append(variants, container)
+	}
+
+	// Publish the variant set under the primary tag to get the canonical
+	// digest-pinned ref, then apply any remaining tags to the same content
+	// instead of re-deriving the ref from whichever tag happens to be last.
+	primaryAddress := fmt.Sprintf("%s/%s:%s", registry, repo, tags[0])
+	ref, err := dag.Container().
+		WithRegistryAuth(registry, username, password).
+		Publish(ctx, primaryAddress, dagger.ContainerPublishOpts{
+			PlatformVariants: variants,
+		})
+	if err != nil {
+		return "", fmt.Errorf("publish %s failed: %w", primaryAddress, err)
+	}
+
+	for _, tag := range tags[1:] {
+		address := fmt.Sprintf("%s/%s:%s", registry, repo, tag)
+
+		if _, err := dag.Container().
+			WithRegistryAuth(registry, username, password).
+			Publish(ctx, address, dagger.ContainerPublishOpts{
+				PlatformVariants: variants,
+			}); err != nil {
+			return "", fmt.Errorf("publish %s failed: %w", address, err)
+		}
+	}
+
+	return ref, nil
+}
+
+// Dev runs the MCP app from a snapshot of the source directory instead of
+// building it, using the dev server's own file watcher to reload on changes
+// made inside the container. Dagger cannot live-mount host files into a
+// running service, so host edits only take effect on the next `dagger call
+// dev up` (which re-snapshots source). Use it for a containerized dev loop
+// without needing a local Node toolchain, not for host-side hot reload.
+func (m *McpAppsRa) Dev(
+	ctx context.Context,
+	// Source directory
+	// +defaultPath="/"
+	source *dagger.Directory,
+	// Port to expose the service on
+	// +optional
+	// +default=3001
+	port int,
+) *dagger.Service {
+	if port == 0 {
+		port = DefaultPort
+	}
+
+	return dag.Container().
+		From("node:20-alpine").
+		WithDirectory("/src", source).
+		WithWorkdir("/src").
+		WithMountedCache("/src/node_modules", dag.CacheVolume("mcp-apps-ra-node-modules")).
+		WithExec([]string{"npm", "install"}).
+		WithExposedPort(port).
+		WithExec([]string{"npm", "run", "dev", "--", "--host", "0.0.0.0", "--port", fmt.Sprintf("%d", port)}).
+		AsService()
+}
+
 // Serve starts the MCP app as a service
 func (m *McpAppsRa) Serve(
 	ctx context.Context,
@@ -41,8 +381,14 @@ func (m *McpAppsRa) Serve(
 	// Port to expose the service on
 	// +default=3001
 	port int,
+	// Directories/files to exclude from the build context
+	// +optional
+	exclude []string,
+	// Directories/files to include in the build context, excluding everything else
+	// +optional
+	include []string,
 ) (*dagger.Service, error) {
-	container, err := m.Build(ctx, source)
+	container, err := m.Build(ctx, source, exclude, include)
 	if err != nil {
 		return nil, err
 	}
@@ -51,3 +397,42 @@ func (m *McpAppsRa) Serve(
 		WithExposedPort(port).
 		AsService(), nil
 }
+
+// IntegrationTest builds the app via Build, exposes it as a service, and
+// binds it into a client container that issues a HEAD request against the
+// MCP SSE endpoint to confirm the server actually starts and responds,
+// without holding the connection open the way a full SSE stream would.
+// Returns the probe output so failures surface in CI logs.
+func (m *McpAppsRa) IntegrationTest(
+	ctx context.Context,
+	// Source directory
+	// +defaultPath="/"
+	source *dagger.Directory,
+	// Port the MCP server listens on
+	// +optional
+	// +default=3001
+	port int,
+) (string, error) {
+	if port == 0 {
+		port = DefaultPort
+	}
+
+	container, err := m.Build(ctx, source, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	svc := container.
+		WithExposedPort(port).
+		AsService()
+
+	return dag.Container().
+		From("curlimages/curl").
+		WithServiceBinding("mcp", svc).
+		WithExec([]string{
+			"curl", "--fail", "--silent", "--show-error", "--max-time", "10", "--head",
+			"-H", "Accept: text/event-stream",
+			fmt.Sprintf("http://mcp:%d/sse", port),
+		}).
+		Stdout(ctx)
+}